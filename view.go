@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Shopify/sarama"
 	"github.com/lovoo/goka/logger"
@@ -34,6 +35,11 @@ type View struct {
 	consumer   sarama.Consumer
 	tmgr       TopicManager
 	state      *Signal
+
+	subs    *subscriptions
+	running int32 // atomic bool, set once the view reaches ViewStateRunning
+
+	pattern *patternTables // non-nil only for Views created via NewViewFromPattern
 }
 
 // NewView creates a new View object from a group.
@@ -44,6 +50,7 @@ func NewView(brokers []string, topic Table, codec Codec, options ...ViewOption)
 			WithViewLogger(logger.Default()),
 			WithViewCallback(DefaultUpdate),
 			WithViewStorageBuilder(storage.DefaultBuilder(DefaultViewStoragePath())),
+			WithViewSubscriptionBuffer(defaultSubscriptionBufSize),
 		},
 
 		// then the user passed options
@@ -75,8 +82,13 @@ func NewView(brokers []string, topic Table, codec Codec, options ...ViewOption)
 		consumer: consumer,
 		tmgr:     tmgr,
 		state:    NewSignal(ViewStateIdle, ViewStateCatchUp, ViewStateRunning).SetState(ViewStateIdle),
+		subs:     newSubscriptions(opts.log, opts.subscriptionBufSize),
 	}
 
+	// wrap the configured update callback so every applied update also fans
+	// out to matching subscribers (see Subscribe/SubscribePrefix/SubscribeRange)
+	opts.updateCallback = v.withSubscriptionNotify(opts.updateCallback)
+
 	if err = v.createPartitions(brokers); err != nil {
 		return nil, err
 	}
@@ -114,6 +126,16 @@ func (v *View) createPartitions(brokers []string) (rerr error) {
 	}
 
 	for partID, p := range partitions {
+		if v.sharded() && !v.opts.shard.assigner.Owns(p) {
+			// not owned by this node: keep the slot so indices still line up
+			// with Kafka partition numbers (ShardStats, ViewServer and the
+			// remote-forwarding paths in view_shard.go all index into
+			// v.partitions by partition number), but don't materialize
+			// storage or consume it from Kafka locally.
+			v.partitions = append(v.partitions, nil)
+			continue
+		}
+
 		v.partitions = append(v.partitions, newPartitionTable(v.topic,
 			p,
 			v.consumer,
@@ -127,6 +149,97 @@ func (v *View) createPartitions(brokers []string) (rerr error) {
 	return nil
 }
 
+// partitionCount returns the number of partition tables this View is
+// responsible for catching up on startup: the owned partitions of
+// v.partitions for a plain or sharded View, or the partitions of every
+// topic already discovered for a pattern View (see NewViewFromPattern).
+// Topics discovered later by watchPatternTopics are started independently
+// and don't affect this count.
+func (v *View) partitionCount() int {
+	if v.pattern != nil {
+		v.pattern.m.RLock()
+		defer v.pattern.m.RUnlock()
+
+		var n int
+		for _, tv := range v.pattern.byTopic {
+			n += len(tv.partitions)
+		}
+		return n
+	}
+
+	var n int
+	for _, p := range v.partitions {
+		if p != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// partitionTablesByTopic returns every partition table this View is
+// currently responsible for, grouped by topic: a single entry keyed by
+// v.topic for a plain or sharded View, or one entry per topic discovered so
+// far for a pattern View (see NewViewFromPattern). It is the shared
+// building block for the functions that otherwise only ever looked at
+// v.partitions and silently ignored pattern Views: Recovered,
+// statsWithContext, and view_lag.go/view_housekeeping.go's per-partition
+// loops.
+func (v *View) partitionTablesByTopic() map[string][]*PartitionTable {
+	if v.pattern != nil {
+		v.pattern.m.RLock()
+		defer v.pattern.m.RUnlock()
+
+		byTopic := make(map[string][]*PartitionTable, len(v.pattern.byTopic))
+		for topic, tv := range v.pattern.byTopic {
+			byTopic[topic] = tv.partitions
+		}
+		return byTopic
+	}
+
+	return map[string][]*PartitionTable{v.topic: v.partitions}
+}
+
+// runPartition hydrates pt from a snapshot (if configured), starts its
+// Kafka catch-up and reports it to multiWait, and wires up the
+// snapshot-writer and housekeeping loops alongside it. It blocks until pt's
+// catch-up errChan closes or ctx is cancelled. multiWait may be nil, e.g.
+// for a pattern-topic partition started after the View already reached
+// ViewStateRunning.
+func (v *View) runPartition(ctx context.Context, errg *multierr.ErrGroup, multiWait *multierr.MultiWait, pt *PartitionTable) error {
+	startOffset, err := v.hydrateFromSnapshot(pt.partition, pt)
+	if err != nil {
+		return err
+	}
+
+	catchupChan, errChan := pt.SetupAndCatchupForeverFrom(ctx, v.opts.restartable, startOffset)
+
+	if multiWait != nil {
+		multiWait.Add(catchupChan)
+	}
+
+	if v.opts.snapshots != nil {
+		errg.Go(func() error {
+			return v.runSnapshotWriter(ctx, pt.partition, pt)
+		})
+	}
+
+	if v.opts.ttl > 0 || v.opts.checkpointInterval > 0 {
+		errg.Go(func() error {
+			return v.housekeeping(ctx, pt)
+		})
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err, ok := <-errChan:
+		if ok && err != nil {
+			return fmt.Errorf("Error while setup/catching up/recovering: %v", err)
+		}
+	}
+	return nil
+}
+
 // Run starts consuming the view's topic.
 func (v *View) Run(ctx context.Context) (rerr error) {
 	v.log.Printf("starting")
@@ -136,30 +249,48 @@ func (v *View) Run(ctx context.Context) (rerr error) {
 
 	errg, ctx := multierr.NewErrGroup(ctx)
 
-	multiWait := multierr.NewMultiWait(ctx, len(v.partitions))
+	multiWait := multierr.NewMultiWait(ctx, v.partitionCount())
 	go func() {
 		if multiWait.Wait() {
 			v.state.SetState(ViewStateRunning)
+			atomic.StoreInt32(&v.running, 1)
 		}
 	}()
 
-	for _, partition := range v.partitions {
-		partition := partition
+	if v.opts.maxLag > 0 {
 		errg.Go(func() error {
-			catchupChan, errChan := partition.SetupAndCatchupForever(ctx, v.opts.restartable)
+			return v.watchLag(ctx)
+		})
+	}
 
-			multiWait.Add(catchupChan)
+	if v.pattern != nil {
+		v.pattern.m.RLock()
+		var initial []*PartitionTable
+		for _, tv := range v.pattern.byTopic {
+			initial = append(initial, tv.partitions...)
+		}
+		v.pattern.m.RUnlock()
 
-			select {
-			case <-ctx.Done():
-				return nil
-			case err, ok := <-errChan:
-				if ok && err != nil {
-					return fmt.Errorf("Error while setup/catching up/recovering: %v", err)
-				}
-			}
-			return nil
+		for _, pt := range initial {
+			pt := pt
+			errg.Go(func() error {
+				return v.runPartition(ctx, errg, multiWait, pt)
+			})
+		}
+
+		errg.Go(func() error {
+			return v.watchPatternTopics(ctx, errg)
 		})
+	} else {
+		for _, partition := range v.partitions {
+			if partition == nil {
+				continue
+			}
+			partition := partition
+			errg.Go(func() error {
+				return v.runPartition(ctx, errg, multiWait, partition)
+			})
+		}
 	}
 
 	// close the view after running
@@ -177,14 +308,37 @@ func (v *View) Run(ctx context.Context) (rerr error) {
 
 // close closes all storage partitions
 func (v *View) close() error {
+	atomic.StoreInt32(&v.running, 0)
+
 	errg, _ := multierr.NewErrGroup(context.Background())
 	for _, p := range v.partitions {
+		if p == nil {
+			continue
+		}
 		p := p
 		errg.Go(func() error {
 			return p.Close()
 		})
 	}
 	v.partitions = nil
+
+	if v.pattern != nil {
+		v.pattern.m.Lock()
+		var pts []*PartitionTable
+		for _, tv := range v.pattern.byTopic {
+			pts = append(pts, tv.partitions...)
+		}
+		v.pattern.byTopic = nil
+		v.pattern.m.Unlock()
+
+		for _, p := range pts {
+			p := p
+			errg.Go(func() error {
+				return p.Close()
+			})
+		}
+	}
+
 	return errg.Wait().NilOrError()
 }
 
@@ -213,9 +367,18 @@ func (v *View) find(key string) (storage.Storage, error) {
 	if err != nil {
 		return nil, err
 	}
+	if v.partitions[h] == nil {
+		return nil, fmt.Errorf("partition %d for key %s is not owned by this node", h, key)
+	}
 	return v.partitions[h].st, nil
 }
 
+// sharded returns true if the View was created with WithViewShard and only
+// materializes a subset of the topic's partitions locally.
+func (v *View) sharded() bool {
+	return v.opts.shard != nil
+}
+
 // Topic returns  the view's topic
 func (v *View) Topic() string {
 	return v.topic
@@ -225,17 +388,32 @@ func (v *View) Topic() string {
 // Get can be called by multiple goroutines concurrently.
 // Get can only be called after Recovered returns true.
 func (v *View) Get(key string) (interface{}, error) {
-	// find partition where key is located
-	s, err := v.find(key)
-	if err != nil {
-		return nil, err
+	var data []byte
+
+	if v.sharded() {
+		partition, err := v.hash(key)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = v.shardGet(context.Background(), partition, key)
+		if err != nil {
+			return nil, fmt.Errorf("error getting value (key %s): %v", key, err)
+		}
+	} else {
+		// find partition where key is located
+		s, err := v.find(key)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = s.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("error getting value (key %s): %v", key, err)
+		}
 	}
 
-	// get key and return
-	data, err := s.Get(key)
-	if err != nil {
-		return nil, fmt.Errorf("error getting value (key %s): %v", key, err)
-	} else if data == nil {
+	if data == nil {
 		return nil, nil
 	}
 
@@ -251,6 +429,14 @@ func (v *View) Get(key string) (interface{}, error) {
 
 // Has checks whether a value for passed key exists in the view.
 func (v *View) Has(key string) (bool, error) {
+	if v.sharded() {
+		partition, err := v.hash(key)
+		if err != nil {
+			return false, err
+		}
+		return v.shardHas(context.Background(), partition, key)
+	}
+
 	// find partition where key is located
 	s, err := v.find(key)
 	if err != nil {
@@ -260,40 +446,57 @@ func (v *View) Has(key string) (bool, error) {
 	return s.Has(key)
 }
 
-// Iterator returns an iterator that iterates over the state of the View.
+// Iterator returns an iterator that iterates over the state of the View. In
+// sharded mode (see WithViewShard), partitions not owned locally are pulled
+// in via an IterateRange RPC against their owner.
 func (v *View) Iterator() (Iterator, error) {
-	iters := make([]storage.Iterator, 0, len(v.partitions))
-	for i := range v.partitions {
-		iter, err := v.partitions[i].st.Iterator()
-		if err != nil {
-			// release already opened iterators
-			for i := range iters {
-				iters[i].Release()
-			}
-
-			return nil, fmt.Errorf("error opening partition iterator: %v", err)
-		}
-
-		iters = append(iters, iter)
-	}
-
-	return &iterator{
-		iter:  storage.NewMultiIterator(iters),
-		codec: v.opts.tableCodec,
-	}, nil
+	return v.iteratorWithRange("", "")
 }
 
 // IteratorWithRange returns an iterator that iterates over the state of the View. This iterator is build using the range.
 func (v *View) IteratorWithRange(start, limit string) (Iterator, error) {
+	return v.iteratorWithRange(start, limit)
+}
+
+// iteratorWithRange builds the multi-partition iterator backing Iterator and
+// IteratorWithRange. An empty start/limit means the full partition. It only
+// covers a single-topic View (plain or sharded); a pattern View (see
+// NewViewFromPattern) has no single partition set to iterate and must use
+// PatternIterator or GetFrom instead.
+func (v *View) iteratorWithRange(start, limit string) (Iterator, error) {
+	if v.pattern != nil {
+		return nil, fmt.Errorf("Iterator/IteratorWithRange can't be used on a View created with NewViewFromPattern; use PatternIterator or GetFrom instead")
+	}
+
 	iters := make([]storage.Iterator, 0, len(v.partitions))
-	for i := range v.partitions {
-		iter, err := v.partitions[i].st.IteratorWithRange([]byte(start), []byte(limit))
-		if err != nil {
-			// release already opened iterators
-			for i := range iters {
-				iters[i].Release()
+	release := func() {
+		for _, it := range iters {
+			it.Release()
+		}
+	}
+
+	for partition := range v.partitions {
+		if v.sharded() && !v.opts.shard.assigner.Owns(int32(partition)) {
+			iter, err := v.remoteIterator(context.Background(), int32(partition), start, limit)
+			if err != nil {
+				release()
+				return nil, fmt.Errorf("error opening remote partition iterator: %v", err)
 			}
+			iters = append(iters, iter)
+			continue
+		}
 
+		var (
+			iter storage.Iterator
+			err  error
+		)
+		if start == "" && limit == "" {
+			iter, err = v.partitions[partition].st.Iterator()
+		} else {
+			iter, err = v.partitions[partition].st.IteratorWithRange([]byte(start), []byte(limit))
+		}
+		if err != nil {
+			release()
 			return nil, fmt.Errorf("error opening partition iterator: %v", err)
 		}
 
@@ -318,10 +521,20 @@ func (v *View) Evict(key string) error {
 }
 
 // Recovered returns true when the view has caught up with events from kafka.
+// In sharded mode (see WithViewShard), only partitions owned by this node
+// are considered. For a pattern View (see NewViewFromPattern), every
+// partition of every topic discovered so far must have caught up; a topic
+// discovered later by watchPatternTopics flips this back to false until it
+// catches up in turn.
 func (v *View) Recovered() bool {
-	for _, p := range v.partitions {
-		if !p.IsRecovered() {
-			return false
+	for _, partitions := range v.partitionTablesByTopic() {
+		for _, p := range partitions {
+			if p == nil {
+				continue
+			}
+			if !p.IsRecovered() {
+				return false
+			}
 		}
 	}
 
@@ -333,6 +546,11 @@ func (v *View) Stats(ctx context.Context) *ViewStats {
 	return v.statsWithContext(ctx)
 }
 
+// statsWithContext populates a ViewStats across every partition table this
+// View is responsible for. For a pattern View (see NewViewFromPattern),
+// that's every partition of every topic discovered so far, reported under
+// stats.Topics[topic] rather than the single-topic stats.Partitions (see
+// partitionTablesByTopic).
 func (v *View) statsWithContext(ctx context.Context) *ViewStats {
 	var (
 		m     sync.Mutex
@@ -340,22 +558,76 @@ func (v *View) statsWithContext(ctx context.Context) *ViewStats {
 	)
 	errg, ctx := multierr.NewErrGroup(ctx)
 
-	for _, partTable := range v.partitions {
-		partTable := partTable
+	byTopic := v.partitionTablesByTopic()
+	if v.pattern != nil {
+		stats.Topics = make(map[string]map[int32]*PartitionViewStats, len(byTopic))
+	}
 
-		errg.Go(func() error {
-			tableStats := partTable.fetchStats(ctx)
-			m.Lock()
-			defer m.Unlock()
+	for topic, partitions := range byTopic {
+		topic, partitions := topic, partitions
 
-			stats.Partitions[partTable.partition] = tableStats
-			return nil
-		})
+		hwms, hwmErr := v.highWaterMarksForTopic(topic, partitions)
+		if hwmErr != nil {
+			v.log.Printf("Error retrieving high water marks for stats (topic %s): %v", topic, hwmErr)
+		}
+
+		dest := stats.Partitions
+		if v.pattern != nil {
+			dest = make(map[int32]*PartitionViewStats, len(partitions))
+			stats.Topics[topic] = dest
+		}
+
+		for _, partTable := range partitions {
+			if partTable == nil {
+				continue
+			}
+			partTable := partTable
+
+			errg.Go(func() error {
+				tableStats := partTable.fetchStats(ctx)
+
+				hs := partTable.housekeepingStats()
+				hs.m.Lock()
+				tableStats.LastPurgeAt = hs.LastPurgeAt
+				tableStats.EvictedKeys = hs.EvictedKeys
+				tableStats.LastCheckpointOffset = hs.LastCheckpointOffset
+				hs.m.Unlock()
+
+				if hwmErr == nil {
+					applied := partTable.CurrentOffset()
+					hwm := hwms[partTable.partition]
+					lag := hwm - applied
+					if lag < 0 {
+						lag = 0
+					}
+					tableStats.HWM = hwm
+					tableStats.AppliedOffset = applied
+					tableStats.Lag = lag
+					tableStats.LastMessageTimestamp = partTable.LastMessageTimestamp()
+				}
+
+				m.Lock()
+				defer m.Unlock()
+
+				dest[partTable.partition] = tableStats
+				return nil
+			})
+		}
 	}
 
 	err := errg.Wait().NilOrError()
 	if err != nil {
 		v.log.Printf("Error retrieving stats: %v", err)
 	}
+
+	if v.sharded() {
+		owned, remote, rpcLatency := v.ShardStats()
+		stats.Shard = &ShardViewStats{
+			OwnedPartitions:  owned,
+			RemotePartitions: remote,
+			RPCLatency:       rpcLatency,
+		}
+	}
+
 	return stats
 }
@@ -0,0 +1,221 @@
+package goka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lovoo/goka/storage"
+)
+
+// EvictPolicy decides what happens to a key whose last update is older than
+// the View's TTL. Implementations usually just delete the key, but may
+// choose to archive it first.
+type EvictPolicy func(st storage.Storage, key string, lastUpdate time.Time) error
+
+// EvictDelete is the default EvictPolicy: it simply deletes the key from
+// local storage.
+func EvictDelete(st storage.Storage, key string, lastUpdate time.Time) error {
+	return st.Delete(key)
+}
+
+// defaultPurgeInterval is the period of the housekeeping loop's purge ticker
+// when no TTL is configured; purge ticks are then skipped.
+const defaultPurgeInterval = time.Minute
+
+// defaultCheckpointInterval is the period of the housekeeping loop's
+// checkpoint ticker when WithViewCheckpointInterval isn't set; checkpoint
+// ticks are then skipped, so no offsets are persisted.
+const defaultCheckpointInterval = 30 * time.Second
+
+// WithViewTTL enables TTL eviction: every d, the housekeeping loop scans
+// local storage and evicts keys whose last update is older than d, using
+// evict (EvictDelete if nil). There is no separate purge interval.
+func WithViewTTL(d time.Duration, evict EvictPolicy) ViewOption {
+	return func(o *voptions) {
+		o.ttl = d
+		if evict == nil {
+			evict = EvictDelete
+		}
+		o.evictPolicy = evict
+	}
+}
+
+// WithViewCheckpointInterval makes the housekeeping loop fsync local storage
+// (if the configured storage.Storage supports it, see storageSyncer) and
+// persist each partition's consumed offset to a CheckpointStore every d.
+// Without a CheckpointStore configured (see WithViewCheckpointStore),
+// checkpointing only syncs storage and updates ViewStats. The View does not
+// read checkpointed offsets back on startup.
+func WithViewCheckpointInterval(d time.Duration) ViewOption {
+	return func(o *voptions) {
+		o.checkpointInterval = d
+	}
+}
+
+// CheckpointStore durably records the offset a View's partition has applied
+// up to. The View only writes to it; on startup, catch-up begins from a
+// snapshot offset (see WithViewSnapshotStore) or the oldest offset, not from
+// a checkpointed one. See WithViewCheckpointStore.
+type CheckpointStore interface {
+	// SaveOffset persists offset as the last checkpointed offset for
+	// partition.
+	SaveOffset(partition int32, offset int64) error
+}
+
+// WithViewCheckpointStore configures store as the durable backend the
+// housekeeping loop's checkpoint tick writes each partition's offset to
+// (see WithViewCheckpointInterval). Without it, checkpointing only syncs
+// local storage and updates ViewStats.
+func WithViewCheckpointStore(store CheckpointStore) ViewOption {
+	return func(o *voptions) {
+		o.checkpointStore = store
+	}
+}
+
+// storageSyncer is implemented by storage.Storage backends that support an
+// explicit durable sync (e.g. flushing a leveldb write batch to disk).
+// storage.Storage itself doesn't require it, so checkpointPartition checks
+// for it via type assertion and skips the sync if unsupported.
+type storageSyncer interface {
+	Sync() error
+}
+
+// housekeepingStats tracks the fields of ViewStats.Partitions populated by
+// the housekeeping loop.
+type housekeepingStats struct {
+	m sync.Mutex
+
+	LastPurgeAt          time.Time
+	EvictedKeys          int64
+	LastCheckpointOffset int64
+}
+
+// housekeeping runs the purge-tick / checkpoint-tick / quit loop for a
+// single partition, modeled after the pattern used elsewhere in goka for
+// background maintenance work.
+func (v *View) housekeeping(ctx context.Context, pt *PartitionTable) error {
+	purgeInterval := v.opts.ttl
+	if purgeInterval <= 0 {
+		purgeInterval = defaultPurgeInterval
+	}
+	checkpointInterval := v.opts.checkpointInterval
+	if checkpointInterval <= 0 {
+		checkpointInterval = defaultCheckpointInterval
+	}
+
+	purgeTicker := time.NewTicker(purgeInterval)
+	defer purgeTicker.Stop()
+
+	checkpointTicker := time.NewTicker(checkpointInterval)
+	defer checkpointTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-purgeTicker.C:
+			if v.opts.ttl <= 0 {
+				continue
+			}
+			if err := v.purgePartition(ctx, pt); err != nil {
+				return fmt.Errorf("error purging partition %d: %v", pt.partition, err)
+			}
+
+		case <-checkpointTicker.C:
+			if v.opts.checkpointInterval <= 0 {
+				continue
+			}
+			if err := v.checkpointPartition(pt); err != nil {
+				return fmt.Errorf("error checkpointing partition %d: %v", pt.partition, err)
+			}
+		}
+	}
+}
+
+// purgePartition scans pt's local storage for keys whose last update
+// exceeds the configured TTL and evicts them via the configured
+// EvictPolicy.
+func (v *View) purgePartition(ctx context.Context, pt *PartitionTable) error {
+	var evicted int64
+
+	iter, err := pt.st.Iterator()
+	if err != nil {
+		return err
+	}
+	defer iter.Release()
+
+	cutoff := time.Now().Add(-v.opts.ttl)
+
+	for iter.Next() {
+		key := string(iter.Key())
+		lastUpdate, ok := pt.LastUpdate(key)
+		if !ok || lastUpdate.After(cutoff) {
+			continue
+		}
+		if err := v.opts.evictPolicy(pt.st, key, lastUpdate); err != nil {
+			return err
+		}
+		evicted++
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	hs := pt.housekeepingStats()
+	hs.m.Lock()
+	hs.LastPurgeAt = time.Now()
+	hs.EvictedKeys += evicted
+	hs.m.Unlock()
+
+	return nil
+}
+
+// checkpointPartition syncs pt's storage (if it supports storageSyncer) and,
+// when a CheckpointStore is configured (see WithViewCheckpointStore),
+// persists its currently applied offset there.
+func (v *View) checkpointPartition(pt *PartitionTable) error {
+	if syncer, ok := pt.st.(storageSyncer); ok {
+		if err := syncer.Sync(); err != nil {
+			return fmt.Errorf("error syncing storage for partition %d: %v", pt.partition, err)
+		}
+	}
+
+	offset := pt.CurrentOffset()
+
+	if v.opts.checkpointStore != nil {
+		if err := v.opts.checkpointStore.SaveOffset(pt.partition, offset); err != nil {
+			return fmt.Errorf("error persisting checkpoint for partition %d: %v", pt.partition, err)
+		}
+	}
+
+	hs := pt.housekeepingStats()
+	hs.m.Lock()
+	hs.LastCheckpointOffset = offset
+	hs.m.Unlock()
+
+	return nil
+}
+
+// Purge manually triggers a TTL eviction pass over every partition this
+// View is responsible for, including every topic discovered so far for a
+// pattern View (see NewViewFromPattern). It is a no-op if WithViewTTL was
+// not configured.
+func (v *View) Purge(ctx context.Context) error {
+	if v.opts.ttl <= 0 {
+		return nil
+	}
+	for _, partitions := range v.partitionTablesByTopic() {
+		for _, pt := range partitions {
+			if pt == nil {
+				continue
+			}
+			if err := v.purgePartition(ctx, pt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package goka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// WithViewMaxLag makes the View fall back from ViewStateRunning to
+// ViewStateCatchUp whenever Lag exceeds maxLag, so load balancers watching
+// WaitRunning / the view's state can drain traffic away from a node that
+// has fallen behind.
+func WithViewMaxLag(maxLag int64) ViewOption {
+	return func(o *voptions) {
+		o.maxLag = maxLag
+	}
+}
+
+// highWaterMarksForTopic returns, per partition, the newest offset
+// available on the broker for topic. It prefers the sarama.Consumer's
+// cached HighWaterMarks, falling back to a direct GetOffset call for
+// partitions the consumer hasn't seen any traffic for yet (e.g. an idle
+// topic).
+func (v *View) highWaterMarksForTopic(topic string, partitions []*PartitionTable) (map[int32]int64, error) {
+	byTopic := v.consumer.HighWaterMarks()[topic]
+
+	var client sarama.Client
+	hwms := make(map[int32]int64, len(partitions))
+	for _, pt := range partitions {
+		if pt == nil {
+			// not owned by this node in sharded mode; its lag is tracked by
+			// its owner.
+			continue
+		}
+
+		if hwm, ok := byTopic[pt.partition]; ok {
+			hwms[pt.partition] = hwm
+			continue
+		}
+
+		if client == nil {
+			var err error
+			client, err = sarama.NewClient(v.brokers, nil)
+			if err != nil {
+				return nil, fmt.Errorf("error creating client to fetch high water marks: %v", err)
+			}
+			defer client.Close()
+		}
+
+		hwm, err := client.GetOffset(topic, pt.partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching high water mark for partition %d of topic %s: %v", pt.partition, topic, err)
+		}
+		hwms[pt.partition] = hwm
+	}
+	return hwms, nil
+}
+
+// PartitionLag reports the freshness of a single partition: the broker's
+// current high water mark, the offset the View has applied so far, the
+// resulting lag, and the timestamp of the last message applied. Topic is
+// only populated for a pattern View (see NewViewFromPattern); it is empty
+// for a plain/sharded View's single topic.
+type PartitionLag struct {
+	Topic                string
+	HWM                  int64
+	AppliedOffset        int64
+	Lag                  int64
+	LastMessageTimestamp time.Time
+}
+
+// PartitionLags returns a PartitionLag per partition of the View. For a
+// pattern View (see NewViewFromPattern), it covers every partition of every
+// topic discovered so far; note that topics whose partition numbers overlap
+// collide in the returned map, so only one topic's entry per partition
+// number is kept (its Topic field says which). View.Stats reports every
+// topic separately under ViewStats.Topics.
+func (v *View) PartitionLags(ctx context.Context) (map[int32]PartitionLag, error) {
+	lags := make(map[int32]PartitionLag)
+
+	for topic, partitions := range v.partitionTablesByTopic() {
+		hwms, err := v.highWaterMarksForTopic(topic, partitions)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pt := range partitions {
+			if pt == nil {
+				continue
+			}
+			applied := pt.CurrentOffset()
+			hwm := hwms[pt.partition]
+			lag := hwm - applied
+			if lag < 0 {
+				lag = 0
+			}
+			lags[pt.partition] = PartitionLag{
+				Topic:                topic,
+				HWM:                  hwm,
+				AppliedOffset:        applied,
+				Lag:                  lag,
+				LastMessageTimestamp: pt.LastMessageTimestamp(),
+			}
+		}
+	}
+	return lags, nil
+}
+
+// Lag returns the total consumer lag of the View, i.e. the sum over every
+// partition of the difference between the partition's high water mark and
+// the offset the View has currently applied. For a pattern View (see
+// NewViewFromPattern), this sums across every topic discovered so far.
+func (v *View) Lag(ctx context.Context) (int64, error) {
+	var total int64
+
+	for topic, partitions := range v.partitionTablesByTopic() {
+		hwms, err := v.highWaterMarksForTopic(topic, partitions)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, pt := range partitions {
+			if pt == nil {
+				continue
+			}
+			lag := hwms[pt.partition] - pt.CurrentOffset()
+			if lag > 0 {
+				total += lag
+			}
+		}
+	}
+	return total, nil
+}
+
+// WaitForOffset blocks until every partition's lag is at or below minLag,
+// or ctx is cancelled. It is useful to implement read-your-writes
+// semantics: after a producer publishes, wait for the View to have caught
+// up before serving reads from it.
+func (v *View) WaitForOffset(ctx context.Context, minLag int64) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		lag, err := v.Lag(ctx)
+		if err != nil {
+			return err
+		}
+		if lag <= minLag {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchLag is started alongside the view's partitions when WithViewMaxLag
+// is configured. It periodically recomputes Lag and drops the view's state
+// back to ViewStateCatchUp when it exceeds the configured threshold,
+// returning to ViewStateRunning once it recovers.
+func (v *View) watchLag(ctx context.Context) error {
+	if v.opts.maxLag <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			lag, err := v.Lag(ctx)
+			if err != nil {
+				v.log.Printf("error computing lag: %v", err)
+				continue
+			}
+
+			if lag > v.opts.maxLag {
+				if v.state.IsState(ViewStateRunning) {
+					v.log.Printf("lag %d exceeds max lag %d, marking view as catching up", lag, v.opts.maxLag)
+					v.state.SetState(ViewStateCatchUp)
+				}
+			} else if v.state.IsState(ViewStateCatchUp) {
+				v.log.Printf("lag %d back within max lag %d, marking view as running", lag, v.opts.maxLag)
+				v.state.SetState(ViewStateRunning)
+			}
+		}
+	}
+}
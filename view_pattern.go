@@ -0,0 +1,342 @@
+package goka
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/lovoo/goka/logger"
+	"github.com/lovoo/goka/multierr"
+	"github.com/lovoo/goka/storage"
+)
+
+// defaultPatternDiscoveryInterval is how often a pattern View re-lists
+// topics to pick up newly created ones matching its pattern.
+const defaultPatternDiscoveryInterval = time.Minute
+
+// WithViewPatternDiscoveryInterval configures how often NewViewFromPattern
+// re-discovers topics matching its pattern. Defaults to
+// defaultPatternDiscoveryInterval.
+func WithViewPatternDiscoveryInterval(d time.Duration) ViewOption {
+	return func(o *voptions) {
+		o.patternDiscoveryInterval = d
+	}
+}
+
+// tableView is a single topic's set of partition tables within a pattern
+// View, keyed by topic name.
+type tableView struct {
+	topic      string
+	partitions []*PartitionTable
+}
+
+// View gains a second mode of operation alongside the single-topic one used
+// by NewView: a pattern View materializes every topic matching a regular
+// expression as its own set of partition tables, and periodically
+// re-discovers the topic list so newly created matching topics are picked
+// up without restarting the process.
+//
+// patternTables is only set by NewViewFromPattern; the single-topic NewView
+// leaves it nil and View.find et al. continue to operate on v.partitions /
+// v.topic as before.
+type patternTables struct {
+	m       sync.RWMutex
+	pattern *regexp.Regexp
+	byTopic map[string]*tableView
+}
+
+// NewViewFromPattern creates a View that discovers every topic matching
+// pattern via the TopicManager, materializes each as its own set of
+// partition tables, and re-discovers on a configurable interval
+// (WithViewPatternDiscoveryInterval) so newly-created matching topics are
+// picked up at runtime, analogous to sarama-cluster's regex-based
+// subscription.
+//
+// This lets one View aggregate many similarly-structured tables (e.g.
+// "orders.region-*") without instantiating and lifecycle-managing N
+// separate View objects.
+func NewViewFromPattern(brokers []string, pattern *regexp.Regexp, codec Codec, options ...ViewOption) (*View, error) {
+	options = append(
+		[]ViewOption{
+			WithViewLogger(logger.Default()),
+			WithViewCallback(DefaultUpdate),
+			WithViewStorageBuilder(storage.DefaultBuilder(DefaultViewStoragePath())),
+			WithViewSubscriptionBuffer(defaultSubscriptionBufSize),
+			WithViewPatternDiscoveryInterval(defaultPatternDiscoveryInterval),
+		},
+		options...,
+	)
+
+	opts := new(voptions)
+	if err := opts.applyOptions(Table(pattern.String()), codec, options...); err != nil {
+		return nil, fmt.Errorf("Error applying user-defined options: %v", err)
+	}
+
+	consumer, err := opts.builders.consumerSarama(brokers, opts.clientID)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating sarama consumer for brokers %+v: %v", brokers, err)
+	}
+	opts.tableCodec = codec
+
+	tmgr, err := opts.builders.topicmgr(brokers)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating topic manager: %v", err)
+	}
+
+	v := &View{
+		brokers:  brokers,
+		topic:    pattern.String(),
+		opts:     opts,
+		log:      opts.log.Prefix(fmt.Sprintf("View %s", pattern)),
+		consumer: consumer,
+		tmgr:     tmgr,
+		state:    NewSignal(ViewStateIdle, ViewStateCatchUp, ViewStateRunning).SetState(ViewStateIdle),
+		subs:     newSubscriptions(opts.log, opts.subscriptionBufSize),
+		pattern:  &patternTables{pattern: pattern, byTopic: make(map[string]*tableView)},
+	}
+	opts.updateCallback = v.withSubscriptionNotify(opts.updateCallback)
+
+	if _, err := v.discoverPatternTopics(brokers); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// discoverPatternTopics lists every topic known to the TopicManager,
+// matches it against v.pattern.pattern, and materializes partition tables
+// for any match not already tracked. It returns the names of the topics
+// newly added by this call, so callers know which ones still need their
+// partitions started (see Run and watchPatternTopics).
+func (v *View) discoverPatternTopics(brokers []string) ([]string, error) {
+	topicNames, err := v.tmgr.Topics()
+	if err != nil {
+		return nil, fmt.Errorf("error listing topics: %v", err)
+	}
+
+	v.pattern.m.Lock()
+	defer v.pattern.m.Unlock()
+
+	var newTopics []string
+	for _, topic := range topicNames {
+		if _, ok := v.pattern.byTopic[topic]; ok {
+			continue
+		}
+		if !v.pattern.pattern.MatchString(topic) {
+			continue
+		}
+
+		partitions, err := v.tmgr.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("error getting partitions for topic %s: %v", topic, err)
+		}
+
+		tv := &tableView{topic: topic}
+		for partID, p := range partitions {
+			tv.partitions = append(tv.partitions, newPartitionTable(topic,
+				p,
+				v.consumer,
+				v.tmgr,
+				v.opts.updateCallback,
+				v.opts.builders.storage,
+				v.log.Prefix(fmt.Sprintf("%s-PartTable-%d", topic, partID)),
+			))
+		}
+
+		v.pattern.byTopic[topic] = tv
+		newTopics = append(newTopics, topic)
+		v.log.Printf("discovered new topic %s matching pattern %s", topic, v.pattern.pattern)
+	}
+
+	return newTopics, nil
+}
+
+// watchPatternTopics periodically re-runs discoverPatternTopics and starts
+// catch-up for every partition of any newly discovered topic, until ctx is
+// cancelled. Partitions of topics discovered on a previous tick (or at
+// construction time, see Run) are never revisited here.
+func (v *View) watchPatternTopics(ctx context.Context, errg *multierr.ErrGroup) error {
+	ticker := time.NewTicker(v.opts.patternDiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			newTopics, err := v.discoverPatternTopics(v.brokers)
+			if err != nil {
+				v.log.Printf("error re-discovering pattern topics: %v", err)
+				continue
+			}
+			if len(newTopics) == 0 {
+				continue
+			}
+
+			v.pattern.m.RLock()
+			var newPartitions []*PartitionTable
+			for _, topic := range newTopics {
+				newPartitions = append(newPartitions, v.pattern.byTopic[topic].partitions...)
+			}
+			v.pattern.m.RUnlock()
+
+			for _, pt := range newPartitions {
+				pt := pt
+				errg.Go(func() error {
+					return v.runPartition(ctx, errg, nil, pt)
+				})
+			}
+		}
+	}
+}
+
+// PatternIterator iterates over every key/value pair across all of a
+// pattern View's materialized tables, yielding the owning topic alongside
+// each pair.
+type PatternIterator interface {
+	Next() bool
+	Topic() string
+	Key() string
+	Value() (interface{}, error)
+	Release()
+	Err() error
+}
+
+type patternIterator struct {
+	view   *View
+	topics []string
+
+	topicIdx int
+	iter     Iterator
+}
+
+// PatternIterator returns a PatternIterator over every table materialized by a
+// View created with NewViewFromPattern.
+func (v *View) PatternIterator() (PatternIterator, error) {
+	if v.pattern == nil {
+		return nil, fmt.Errorf("PatternIterator can only be used on a View created with NewViewFromPattern")
+	}
+
+	v.pattern.m.RLock()
+	topics := make([]string, 0, len(v.pattern.byTopic))
+	for topic := range v.pattern.byTopic {
+		topics = append(topics, topic)
+	}
+	v.pattern.m.RUnlock()
+
+	return &patternIterator{view: v, topics: topics, topicIdx: -1}, nil
+}
+
+func (p *patternIterator) Next() bool {
+	for {
+		if p.iter != nil && p.iter.Next() {
+			return true
+		}
+		if p.iter != nil {
+			p.iter.Release()
+			p.iter = nil
+		}
+
+		p.topicIdx++
+		if p.topicIdx >= len(p.topics) {
+			return false
+		}
+
+		iter, err := p.view.topicIterator(p.topics[p.topicIdx])
+		if err != nil {
+			continue
+		}
+		p.iter = iter
+	}
+}
+
+func (p *patternIterator) Topic() string {
+	return p.topics[p.topicIdx]
+}
+
+func (p *patternIterator) Key() string {
+	return p.iter.Key()
+}
+
+func (p *patternIterator) Value() (interface{}, error) {
+	return p.iter.Value()
+}
+
+func (p *patternIterator) Err() error {
+	if p.iter == nil {
+		return nil
+	}
+	return p.iter.Err()
+}
+
+func (p *patternIterator) Release() {
+	if p.iter != nil {
+		p.iter.Release()
+	}
+}
+
+// topicIterator returns an Iterator over a single table of a pattern View.
+func (v *View) topicIterator(topic string) (Iterator, error) {
+	v.pattern.m.RLock()
+	tv, ok := v.pattern.byTopic[topic]
+	v.pattern.m.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown topic %s", topic)
+	}
+
+	iters := make([]storage.Iterator, 0, len(tv.partitions))
+	for _, pt := range tv.partitions {
+		iter, err := pt.st.Iterator()
+		if err != nil {
+			for _, it := range iters {
+				it.Release()
+			}
+			return nil, fmt.Errorf("error opening partition iterator for topic %s: %v", topic, err)
+		}
+		iters = append(iters, iter)
+	}
+
+	return &iterator{
+		iter:  storage.NewMultiIterator(iters),
+		codec: v.opts.tableCodec,
+	}, nil
+}
+
+// GetFrom returns the value for key in the partition table belonging to
+// topic. Unlike Get, which only makes sense for a single-topic View,
+// GetFrom lets a pattern View (see NewViewFromPattern) address one of its
+// many materialized tables explicitly.
+func (v *View) GetFrom(topic, key string) (interface{}, error) {
+	if v.pattern == nil {
+		return nil, fmt.Errorf("GetFrom can only be used on a View created with NewViewFromPattern")
+	}
+
+	v.pattern.m.RLock()
+	tv, ok := v.pattern.byTopic[topic]
+	v.pattern.m.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown topic %s", topic)
+	}
+
+	hasher := v.opts.hasher()
+	if _, err := hasher.Write([]byte(key)); err != nil {
+		return nil, err
+	}
+	hash := int32(hasher.Sum32())
+	if hash < 0 {
+		hash = -hash
+	}
+	partition := hash % int32(len(tv.partitions))
+
+	data, err := tv.partitions[partition].st.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("error getting value (topic %s, key %s): %v", topic, key, err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	return v.opts.tableCodec.Decode(data)
+}
@@ -0,0 +1,402 @@
+package goka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/lovoo/goka/logger"
+	"github.com/lovoo/goka/storage"
+)
+
+// PartitionAssigner determines which partitions of a sharded View are
+// materialized locally and where the owner of any other partition can be
+// reached. Implementations typically derive ownership from Kafka
+// consumer-group membership (e.g. by embedding custom UserData in the
+// group's Join/Sync messages, similar to how bsm/sarama-cluster distributes
+// partitions), so that ownership follows the consumer group's rebalances.
+type PartitionAssigner interface {
+	// Owns returns true if partition is materialized by the local View.
+	Owns(partition int32) bool
+	// Resolve returns the gRPC address of the peer currently responsible
+	// for partition. It returns an error if no owner is known, e.g. right
+	// after a rebalance.
+	Resolve(partition int32) (addr string, err error)
+}
+
+// shardStats holds the sharding-related counters exposed through ViewStats.
+type shardStats struct {
+	m sync.Mutex
+
+	OwnedPartitions  int
+	RemotePartitions int
+	RPCLatency       time.Duration
+}
+
+// shard bundles the state a View needs to operate in sharded mode: an
+// assigner that tells it which partitions it owns, and a pool of gRPC
+// clients to reach the owners of the rest.
+type shard struct {
+	log      logger.Logger
+	assigner PartitionAssigner
+	dialOpts []grpc.DialOption
+
+	mConns sync.Mutex
+	conns  map[string]*grpc.ClientConn
+
+	stats shardStats
+}
+
+func newShard(log logger.Logger, assigner PartitionAssigner, dialOpts ...grpc.DialOption) *shard {
+	return &shard{
+		log:      log,
+		assigner: assigner,
+		dialOpts: dialOpts,
+		conns:    make(map[string]*grpc.ClientConn),
+	}
+}
+
+// WithViewShard puts the View into sharded mode: instead of materializing
+// every partition of the table locally, the View only keeps the partitions
+// assigned to it by assignment and forwards Get/Has/Iterator calls for
+// partitions it does not own to the peer process that does, over gRPC.
+//
+// This allows tables that do not fit on a single node to be split across a
+// fleet of View processes that serve each other's lookups.
+func WithViewShard(assignment PartitionAssigner, dialOpts ...grpc.DialOption) ViewOption {
+	return func(o *voptions) {
+		o.shard = newShard(o.log, assignment, dialOpts...)
+	}
+}
+
+// conn returns a (possibly cached) gRPC connection to addr.
+func (s *shard) conn(addr string) (*grpc.ClientConn, error) {
+	s.mConns.Lock()
+	defer s.mConns.Unlock()
+
+	if c, ok := s.conns[addr]; ok {
+		return c, nil
+	}
+
+	c, err := grpc.Dial(addr, append([]grpc.DialOption{grpc.WithInsecure()}, s.dialOpts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing view peer %s: %v", addr, err)
+	}
+	s.conns[addr] = c
+	return c, nil
+}
+
+// defaultShardRPCTimeout bounds how long a Get/Has waits on a peer before
+// giving up, so a partner that went away during a reshuffle can't hang a
+// caller's lookup forever.
+const defaultShardRPCTimeout = 5 * time.Second
+
+// shardGet resolves the owner of key's partition and fetches the value, either
+// locally or by issuing a GetByPartition RPC to the owning peer. The
+// resolved owner is retried once on failure, since a stale Resolve result
+// (e.g. right after a reshuffle) is the most common reason the RPC fails.
+func (v *View) shardGet(ctx context.Context, partition int32, key string) ([]byte, error) {
+	sh := v.opts.shard
+	if sh.assigner.Owns(partition) {
+		return v.partitions[partition].st.Get(key)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultShardRPCTimeout)
+	defer cancel()
+
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		addr, err := sh.assigner.Resolve(partition)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving owner of partition %d: %v", partition, err)
+		}
+
+		conn, err := sh.conn(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		start := time.Now()
+		resp, err := NewViewServiceClient(conn).GetByPartition(ctx, &GetByPartitionRequest{
+			Topic:     v.topic,
+			Partition: partition,
+			Key:       key,
+		})
+		sh.stats.m.Lock()
+		sh.stats.RPCLatency = time.Since(start)
+		sh.stats.m.Unlock()
+		if err != nil {
+			lastErr = fmt.Errorf("error calling GetByPartition on %s: %v", addr, err)
+			continue
+		}
+		if !resp.Found {
+			return nil, nil
+		}
+		return resp.Value, nil
+	}
+	return nil, lastErr
+}
+
+// shardHas mirrors shardGet for existence checks.
+func (v *View) shardHas(ctx context.Context, partition int32, key string) (bool, error) {
+	sh := v.opts.shard
+	if sh.assigner.Owns(partition) {
+		return v.partitions[partition].st.Has(key)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultShardRPCTimeout)
+	defer cancel()
+
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		addr, err := sh.assigner.Resolve(partition)
+		if err != nil {
+			return false, fmt.Errorf("error resolving owner of partition %d: %v", partition, err)
+		}
+
+		conn, err := sh.conn(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		resp, err := NewViewServiceClient(conn).HasByPartition(ctx, &HasByPartitionRequest{
+			Topic:     v.topic,
+			Partition: partition,
+			Key:       key,
+		})
+		if err != nil {
+			lastErr = fmt.Errorf("error calling HasByPartition on %s: %v", addr, err)
+			continue
+		}
+		return resp.Found, nil
+	}
+	return false, lastErr
+}
+
+// shardIterate streams an IterateRange RPC against the owner of partition
+// and feeds the results into the passed callback. Used by View.Iterator and
+// View.IteratorWithRange to cover remote partitions transparently.
+func (v *View) shardIterate(ctx context.Context, partition int32, start, limit string, cb func(key string, value []byte) error) error {
+	sh := v.opts.shard
+	addr, err := sh.assigner.Resolve(partition)
+	if err != nil {
+		return fmt.Errorf("error resolving owner of partition %d: %v", partition, err)
+	}
+
+	conn, err := sh.conn(addr)
+	if err != nil {
+		return err
+	}
+
+	stream, err := NewViewServiceClient(conn).IterateRange(ctx, &IterateRangeRequest{
+		Topic:     v.topic,
+		Partition: partition,
+		Start:     start,
+		Limit:     limit,
+	})
+	if err != nil {
+		return fmt.Errorf("error calling IterateRange on %s: %v", addr, err)
+	}
+
+	for {
+		kv, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("error streaming IterateRange from %s: %v", addr, err)
+		}
+		if err := cb(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+}
+
+// remoteIterator fetches every key/value pair of partition's range from its
+// owning peer up front and replays it as a storage.Iterator, so remote
+// partitions can be merged into the same storage.MultiIterator as the local
+// ones in View.Iterator / View.IteratorWithRange.
+func (v *View) remoteIterator(ctx context.Context, partition int32, start, limit string) (storage.Iterator, error) {
+	var kvs []KeyValue
+	err := v.shardIterate(ctx, partition, start, limit, func(key string, value []byte) error {
+		kvs = append(kvs, KeyValue{Key: key, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newBufferedIterator(kvs), nil
+}
+
+// bufferedIterator is a storage.Iterator over an in-memory slice of
+// key/value pairs, used to present the result of a remote IterateRange RPC
+// as a regular iterator.
+type bufferedIterator struct {
+	kvs []KeyValue
+	pos int
+}
+
+func newBufferedIterator(kvs []KeyValue) *bufferedIterator {
+	return &bufferedIterator{kvs: kvs, pos: -1}
+}
+
+func (b *bufferedIterator) Next() bool {
+	b.pos++
+	return b.pos < len(b.kvs)
+}
+
+func (b *bufferedIterator) Key() []byte {
+	return []byte(b.kvs[b.pos].Key)
+}
+
+func (b *bufferedIterator) Value() ([]byte, error) {
+	return b.kvs[b.pos].Value, nil
+}
+
+func (b *bufferedIterator) Err() error {
+	return nil
+}
+
+func (b *bufferedIterator) Release() {}
+
+func (b *bufferedIterator) Seek(key []byte) bool {
+	for i, kv := range b.kvs {
+		if kv.Key >= string(key) {
+			b.pos = i - 1
+			return true
+		}
+	}
+	b.pos = len(b.kvs)
+	return false
+}
+
+// ShardStats reports sharding-related counters for a View created with
+// WithViewShard: how many of its partitions are owned locally vs served by
+// peers, and the latency of the last GetByPartition RPC issued by Get (Has
+// and Iterator don't record latency). It returns the zero
+// value for a View that isn't sharded.
+func (v *View) ShardStats() (owned, remote int, rpcLatency time.Duration) {
+	if !v.sharded() {
+		return 0, 0, 0
+	}
+
+	for partition := range v.partitions {
+		if v.opts.shard.assigner.Owns(int32(partition)) {
+			owned++
+		} else {
+			remote++
+		}
+	}
+
+	v.opts.shard.stats.m.Lock()
+	rpcLatency = v.opts.shard.stats.RPCLatency
+	v.opts.shard.stats.m.Unlock()
+
+	return owned, remote, rpcLatency
+}
+
+// ViewServer exposes a running, sharded View to its peers over gRPC,
+// serving GetByPartition, HasByPartition and IterateRange for the
+// partitions owned by this process. Run one alongside every sharded View so
+// the View's peers can resolve lookups for partitions it owns.
+type ViewServer struct {
+	view *View
+	srv  *grpc.Server
+}
+
+// NewViewServer creates a ViewServer backed by view. Call Serve to start
+// accepting peer requests.
+func NewViewServer(view *View) *ViewServer {
+	s := grpc.NewServer()
+	vs := &ViewServer{view: view, srv: s}
+	RegisterViewServiceServer(s, vs)
+	return vs
+}
+
+// Serve blocks, accepting and serving RPCs from lis until ctx is cancelled.
+func (s *ViewServer) Serve(ctx context.Context, lis net.Listener) error {
+	errc := make(chan error, 1)
+	go func() { errc <- s.srv.Serve(lis) }()
+
+	select {
+	case <-ctx.Done():
+		s.srv.GracefulStop()
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+// notOwned returns a non-nil error if partition isn't materialized locally,
+// e.g. right after a reshuffle moved it away before the caller's Resolve
+// result (or this server's PartitionAssigner) caught up.
+func (s *ViewServer) notOwned(partition int32, topic string) error {
+	if int(partition) >= len(s.view.partitions) || s.view.partitions[partition] == nil {
+		return fmt.Errorf("partition %d for topic %s is not owned by this node, try resolving again", partition, topic)
+	}
+	return nil
+}
+
+// GetByPartition implements ViewServiceServer.
+func (s *ViewServer) GetByPartition(ctx context.Context, req *GetByPartitionRequest) (*GetByPartitionResponse, error) {
+	if err := s.notOwned(req.Partition, req.Topic); err != nil {
+		return nil, err
+	}
+	value, err := s.view.partitions[req.Partition].st.Get(req.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %s: %v", req.Key, err)
+	}
+	return &GetByPartitionResponse{Value: value, Found: value != nil}, nil
+}
+
+// HasByPartition implements ViewServiceServer.
+func (s *ViewServer) HasByPartition(ctx context.Context, req *HasByPartitionRequest) (*HasByPartitionResponse, error) {
+	if err := s.notOwned(req.Partition, req.Topic); err != nil {
+		return nil, err
+	}
+	found, err := s.view.partitions[req.Partition].st.Has(req.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error checking key %s: %v", req.Key, err)
+	}
+	return &HasByPartitionResponse{Found: found}, nil
+}
+
+// IterateRange implements ViewServiceServer, streaming every key/value pair
+// of the requested partition's range to the peer that asked for it.
+func (s *ViewServer) IterateRange(req *IterateRangeRequest, stream ViewService_IterateRangeServer) error {
+	if err := s.notOwned(req.Partition, req.Topic); err != nil {
+		return err
+	}
+
+	var (
+		iter storage.Iterator
+		err  error
+	)
+	if req.Start == "" && req.Limit == "" {
+		iter, err = s.view.partitions[req.Partition].st.Iterator()
+	} else {
+		iter, err = s.view.partitions[req.Partition].st.IteratorWithRange([]byte(req.Start), []byte(req.Limit))
+	}
+	if err != nil {
+		return fmt.Errorf("error opening iterator: %v", err)
+	}
+	defer iter.Release()
+
+	for iter.Next() {
+		value, err := iter.Value()
+		if err != nil {
+			return fmt.Errorf("error reading value: %v", err)
+		}
+		if err := stream.Send(&KeyValue{Key: string(iter.Key()), Value: value}); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
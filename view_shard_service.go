@@ -0,0 +1,220 @@
+package goka
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// The types and service plumbing below stand in for what protoc-gen-go-grpc
+// would normally generate from a view_shard.proto describing the
+// ViewService used to serve remote partition lookups between sharded
+// Views. They are hand-written here to keep the feature self-contained.
+//
+// Since GetByPartitionRequest et al. are plain structs rather than
+// generated protobuf messages, grpc-go's default codec (which requires
+// proto.Message) can't marshal them. gobCodec below is registered under
+// the "proto" name so it replaces the default codec for every call that
+// doesn't explicitly request a content-subtype, which covers all of the
+// calls made through ViewServiceClient/ViewServiceServer.
+func init() {
+	encoding.RegisterCodec(gobCodec{})
+}
+
+// gobCodec marshals gRPC messages with encoding/gob. It registers itself
+// under grpc-go's default codec name ("proto") so ViewService's hand-rolled
+// plain-struct messages work without pulling in a real protobuf toolchain.
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) Name() string {
+	return "proto"
+}
+
+// GetByPartitionRequest asks the owner of Partition for Key.
+type GetByPartitionRequest struct {
+	Topic     string
+	Partition int32
+	Key       string
+}
+
+// GetByPartitionResponse carries the (possibly absent) value for the
+// requested key.
+type GetByPartitionResponse struct {
+	Value []byte
+	Found bool
+}
+
+// HasByPartitionRequest asks the owner of Partition whether Key exists.
+type HasByPartitionRequest struct {
+	Topic     string
+	Partition int32
+	Key       string
+}
+
+// HasByPartitionResponse answers a HasByPartitionRequest.
+type HasByPartitionResponse struct {
+	Found bool
+}
+
+// IterateRangeRequest asks the owner of Partition to stream every key/value
+// pair in [Start, Limit). An empty Start/Limit requests the full partition.
+type IterateRangeRequest struct {
+	Topic     string
+	Partition int32
+	Start     string
+	Limit     string
+}
+
+// KeyValue is a single entry streamed back by IterateRange.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// ViewServiceClient is the client API for ViewService, used by a sharded
+// View to reach the peer owning a partition it doesn't have locally.
+type ViewServiceClient interface {
+	GetByPartition(ctx context.Context, in *GetByPartitionRequest, opts ...grpc.CallOption) (*GetByPartitionResponse, error)
+	HasByPartition(ctx context.Context, in *HasByPartitionRequest, opts ...grpc.CallOption) (*HasByPartitionResponse, error)
+	IterateRange(ctx context.Context, in *IterateRangeRequest, opts ...grpc.CallOption) (ViewService_IterateRangeClient, error)
+}
+
+// ViewService_IterateRangeClient is the client-side stream of KeyValues
+// returned by IterateRange.
+type ViewService_IterateRangeClient interface {
+	Recv() (*KeyValue, error)
+}
+
+// ViewService_IterateRangeServer is the server-side stream used to send
+// KeyValues back to the caller of IterateRange.
+type ViewService_IterateRangeServer interface {
+	Send(*KeyValue) error
+}
+
+// ViewServiceServer is the server API for ViewService, implemented by
+// ViewServer on behalf of a locally running View.
+type ViewServiceServer interface {
+	GetByPartition(context.Context, *GetByPartitionRequest) (*GetByPartitionResponse, error)
+	HasByPartition(context.Context, *HasByPartitionRequest) (*HasByPartitionResponse, error)
+	IterateRange(*IterateRangeRequest, ViewService_IterateRangeServer) error
+}
+
+var viewServiceDesc = grpc.ServiceDesc{
+	ServiceName: "goka.ViewService",
+	HandlerType: (*ViewServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetByPartition",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(GetByPartitionRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(ViewServiceServer).GetByPartition(ctx, in)
+			},
+		},
+		{
+			MethodName: "HasByPartition",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(HasByPartitionRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(ViewServiceServer).HasByPartition(ctx, in)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "IterateRange",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				in := new(IterateRangeRequest)
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(ViewServiceServer).IterateRange(in, &viewServiceIterateRangeServer{stream})
+			},
+		},
+	},
+}
+
+// RegisterViewServiceServer registers impl with s so it starts handling
+// ViewService RPCs once s.Serve is called.
+func RegisterViewServiceServer(s *grpc.Server, impl ViewServiceServer) {
+	s.RegisterService(&viewServiceDesc, impl)
+}
+
+type viewServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewViewServiceClient creates a ViewServiceClient backed by cc.
+func NewViewServiceClient(cc *grpc.ClientConn) ViewServiceClient {
+	return &viewServiceClient{cc: cc}
+}
+
+func (c *viewServiceClient) GetByPartition(ctx context.Context, in *GetByPartitionRequest, opts ...grpc.CallOption) (*GetByPartitionResponse, error) {
+	out := new(GetByPartitionResponse)
+	if err := c.cc.Invoke(ctx, "/goka.ViewService/GetByPartition", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *viewServiceClient) HasByPartition(ctx context.Context, in *HasByPartitionRequest, opts ...grpc.CallOption) (*HasByPartitionResponse, error) {
+	out := new(HasByPartitionResponse)
+	if err := c.cc.Invoke(ctx, "/goka.ViewService/HasByPartition", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *viewServiceClient) IterateRange(ctx context.Context, in *IterateRangeRequest, opts ...grpc.CallOption) (ViewService_IterateRangeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &viewServiceDesc.Streams[0], "/goka.ViewService/IterateRange", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &viewServiceIterateRangeClient{stream}, nil
+}
+
+type viewServiceIterateRangeClient struct {
+	grpc.ClientStream
+}
+
+func (c *viewServiceIterateRangeClient) Recv() (*KeyValue, error) {
+	kv := new(KeyValue)
+	if err := c.ClientStream.RecvMsg(kv); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+type viewServiceIterateRangeServer struct {
+	grpc.ServerStream
+}
+
+func (s *viewServiceIterateRangeServer) Send(kv *KeyValue) error {
+	return s.ServerStream.SendMsg(kv)
+}
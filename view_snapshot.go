@@ -0,0 +1,127 @@
+package goka
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// SnapshotStore persists and restores the materialized state of a single
+// partition so a fresh View can skip most of the Kafka catch-up phase.
+// Implementations typically back onto an object store such as S3 or GCS, or
+// a local directory during development.
+type SnapshotStore interface {
+	// Load returns a reader over the most recent snapshot of partition and
+	// the Kafka offset it was taken at, so the caller can seed its consumer
+	// there and replay only what's newer. It returns (nil, 0, nil) if no
+	// snapshot exists yet.
+	Load(partition int32) (r io.ReadCloser, offset int64, err error)
+	// Store persists r, the content of partition's local storage, as the
+	// new snapshot, tagged with the Kafka offset it was taken at.
+	Store(partition int32, offset int64, r io.Reader) error
+}
+
+// snapshotGroupSuffix is appended to the View's consumer group used for
+// snapshot-writer leader election, so it doesn't collide with the group the
+// View itself might use elsewhere.
+const snapshotGroupSuffix = "-snapshot-writer"
+
+// WithViewSnapshotStore configures store as the snapshot backend for a
+// View. On startup each partition first hydrates from store before falling
+// back to a full Kafka replay, and a single leader-elected process per
+// partition periodically checkpoints local storage back to store.
+func WithViewSnapshotStore(store SnapshotStore) ViewOption {
+	return func(o *voptions) {
+		o.snapshots = store
+	}
+}
+
+// WithViewSnapshotInterval sets how often the elected leader checkpoints
+// each partition's local storage to the SnapshotStore. Defaults to
+// defaultSnapshotInterval.
+func WithViewSnapshotInterval(d time.Duration) ViewOption {
+	return func(o *voptions) {
+		o.snapshotInterval = d
+	}
+}
+
+// defaultSnapshotInterval is how often partitions are checkpointed to the
+// SnapshotStore when WithViewSnapshotStore is used without an explicit
+// WithViewSnapshotInterval.
+const defaultSnapshotInterval = 5 * time.Minute
+
+// hydrateFromSnapshot loads the most recent snapshot of partition (if any)
+// into pt's storage and returns the Kafka offset the View's consumer should resume
+// from. It returns sarama.OffsetOldest if no snapshot exists, so the
+// partition falls back to a full replay.
+func (v *View) hydrateFromSnapshot(partition int32, pt *PartitionTable) (int64, error) {
+	if v.opts.snapshots == nil {
+		return sarama.OffsetOldest, nil
+	}
+
+	r, offset, err := v.opts.snapshots.Load(partition)
+	if err != nil {
+		return 0, fmt.Errorf("error loading snapshot for partition %d: %v", partition, err)
+	}
+	if r == nil {
+		v.log.Printf("no snapshot found for partition %d, falling back to full replay", partition)
+		return sarama.OffsetOldest, nil
+	}
+	defer r.Close()
+
+	if err := pt.LoadSnapshot(r); err != nil {
+		return 0, fmt.Errorf("error loading snapshot into partition %d: %v", partition, err)
+	}
+
+	v.log.Printf("hydrated partition %d from snapshot at offset %d", partition, offset)
+	return offset, nil
+}
+
+// runSnapshotWriter periodically checkpoints the partition's local storage
+// to the SnapshotStore, but only while this process holds snapshot-writer
+// leadership for the partition, so that only one writer per partition ever
+// runs at a time across a deployment.
+func (v *View) runSnapshotWriter(ctx context.Context, partition int32, pt *PartitionTable) error {
+	if v.opts.snapshots == nil {
+		return nil
+	}
+
+	leader, err := v.opts.builders.snapshotLeader(v.brokers, v.opts.clientID, v.topic+snapshotGroupSuffix)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot-writer leader election for partition %d: %v", partition, err)
+	}
+	defer leader.Close()
+
+	interval := v.opts.snapshotInterval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if !leader.IsLeader(partition) {
+				continue
+			}
+
+			offset := pt.CurrentOffset()
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(pt.DumpSnapshot(pw))
+			}()
+
+			if err := v.opts.snapshots.Store(partition, offset, pr); err != nil {
+				v.log.Printf("error storing snapshot for partition %d: %v", partition, err)
+				continue
+			}
+			v.log.Printf("checkpointed partition %d to snapshot at offset %d", partition, offset)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package goka
+
+import "time"
+
+// ViewStats holds a point-in-time snapshot of a View's performance and
+// health metrics, returned by View.Stats.
+type ViewStats struct {
+	Partitions map[int32]*PartitionViewStats
+
+	// Topics holds per-partition stats grouped by topic for a pattern View
+	// (see NewViewFromPattern). It is nil for a plain/sharded View; use
+	// Partitions there instead.
+	Topics map[string]map[int32]*PartitionViewStats
+
+	// Shard holds sharding-related counters (see WithViewShard). It is nil
+	// for a View that isn't sharded.
+	Shard *ShardViewStats
+}
+
+// newViewStats returns an empty ViewStats ready to be populated by
+// statsWithContext.
+func newViewStats() *ViewStats {
+	return &ViewStats{
+		Partitions: make(map[int32]*PartitionViewStats),
+	}
+}
+
+// PartitionViewStats holds the metrics tracked for a single partition table:
+// its catch-up state (populated by PartitionTable.fetchStats), the TTL and
+// checkpointing counters recorded by the housekeeping loop (see
+// view_housekeeping.go), and its consumer-lag/freshness metrics (see
+// view_lag.go).
+type PartitionViewStats struct {
+	Recovered bool
+
+	// LastPurgeAt, EvictedKeys and LastCheckpointOffset are populated by the
+	// housekeeping loop when WithViewTTL / WithViewCheckpointInterval is
+	// configured; they stay zero otherwise.
+	LastPurgeAt          time.Time
+	EvictedKeys          int64
+	LastCheckpointOffset int64
+
+	// HWM, AppliedOffset, Lag and LastMessageTimestamp are populated from
+	// the same data View.Lag/View.PartitionLags compute.
+	HWM                  int64
+	AppliedOffset        int64
+	Lag                  int64
+	LastMessageTimestamp time.Time
+}
+
+// ShardViewStats holds sharding-related counters for a View created with
+// WithViewShard (see View.ShardStats).
+type ShardViewStats struct {
+	OwnedPartitions  int
+	RemotePartitions int
+	RPCLatency       time.Duration
+}
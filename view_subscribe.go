@@ -0,0 +1,232 @@
+package goka
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lovoo/goka/logger"
+	"github.com/lovoo/goka/storage"
+)
+
+// subscriptionCallback is invoked whenever a subscribed key is updated.
+// oldVal is nil if the key did not previously exist.
+type subscriptionCallback func(key string, oldVal, newVal interface{})
+
+// subscriptionKind distinguishes the three ways a Subscription can match a
+// key.
+type subscriptionKind int
+
+const (
+	subscribeExact subscriptionKind = iota
+	subscribePrefix
+	subscribeRange
+)
+
+// Subscription represents a registered callback on a View. Call Close to
+// stop receiving updates.
+type Subscription struct {
+	view *View
+	id   uint64
+
+	kind         subscriptionKind
+	key          string
+	start, limit string
+	cb           subscriptionCallback
+
+	updates chan keyUpdate
+	done    chan struct{}
+	closed  sync.Once
+}
+
+// keyUpdate is a single decoded update fanned out to matching subscriptions.
+type keyUpdate struct {
+	key            string
+	oldVal, newVal interface{}
+}
+
+// Close stops the subscription. No more callbacks will fire after Close
+// returns, but a callback already in flight may still be running. Close is
+// idempotent; calling it more than once is a no-op.
+func (s *Subscription) Close() error {
+	s.closed.Do(func() {
+		s.view.subs.remove(s.id)
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *Subscription) matches(key string) bool {
+	switch s.kind {
+	case subscribeExact:
+		return key == s.key
+	case subscribePrefix:
+		return strings.HasPrefix(key, s.key)
+	case subscribeRange:
+		return key >= s.start && key < s.limit
+	}
+	return false
+}
+
+// deliver enqueues an update for the subscription's dispatch loop. If the
+// buffer is full the update is dropped and a warning logged, so a single
+// slow consumer cannot stall the partition's update path.
+func (s *Subscription) deliver(log logger.Logger, u keyUpdate) {
+	select {
+	case s.updates <- u:
+	default:
+		log.Printf("subscription on %s is falling behind, dropping update for key %s", s.key, u.key)
+	}
+}
+
+func (s *Subscription) run() {
+	for {
+		select {
+		case u := <-s.updates:
+			// select picks randomly among ready cases, so check done again
+			// before delivering a buffered update after Close
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			s.cb(u.key, u.oldVal, u.newVal)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// subscriptions tracks all Subscriptions registered on a View and fans out
+// storage updates to the ones matching a given key.
+type subscriptions struct {
+	m      sync.RWMutex
+	nextID uint64
+	byID   map[uint64]*Subscription
+
+	bufSize int
+	log     logger.Logger
+}
+
+func newSubscriptions(log logger.Logger, bufSize int) *subscriptions {
+	return &subscriptions{
+		byID:    make(map[uint64]*Subscription),
+		bufSize: bufSize,
+		log:     log,
+	}
+}
+
+func (s *subscriptions) add(view *View, kind subscriptionKind, key, start, limit string, cb subscriptionCallback) *Subscription {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.nextID++
+	sub := &Subscription{
+		view:    view,
+		id:      s.nextID,
+		kind:    kind,
+		key:     key,
+		start:   start,
+		limit:   limit,
+		cb:      cb,
+		updates: make(chan keyUpdate, s.bufSize),
+		done:    make(chan struct{}),
+	}
+	s.byID[sub.id] = sub
+	go sub.run()
+	return sub
+}
+
+func (s *subscriptions) remove(id uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.byID, id)
+}
+
+// notify fans an update for key out to every matching, still-open
+// subscription. It must only be called once the View has reached
+// ViewStateRunning, so subscribers don't get flooded by the replay of the
+// whole log during catch-up.
+func (s *subscriptions) notify(key string, oldVal, newVal interface{}) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	u := keyUpdate{key: key, oldVal: oldVal, newVal: newVal}
+	for _, sub := range s.byID {
+		if sub.matches(key) {
+			sub.deliver(s.log, u)
+		}
+	}
+}
+
+// defaultSubscriptionBufSize is the number of pending updates buffered per
+// Subscription before new ones are dropped in favor of keeping the
+// partition's update path unblocked.
+const defaultSubscriptionBufSize = 64
+
+// Subscribe registers cb to be called whenever key is updated from the
+// Kafka log once the View has caught up. The returned Subscription must be
+// closed to stop receiving updates.
+func (v *View) Subscribe(key string, cb func(key string, oldVal, newVal interface{})) *Subscription {
+	return v.subs.add(v, subscribeExact, key, "", "", cb)
+}
+
+// SubscribePrefix registers cb to be called whenever a key starting with
+// prefix is updated.
+func (v *View) SubscribePrefix(prefix string, cb func(key string, oldVal, newVal interface{})) *Subscription {
+	return v.subs.add(v, subscribePrefix, prefix, "", "", cb)
+}
+
+// SubscribeRange registers cb to be called whenever a key in [start, limit)
+// is updated.
+func (v *View) SubscribeRange(start, limit string, cb func(key string, oldVal, newVal interface{})) *Subscription {
+	return v.subs.add(v, subscribeRange, "", start, limit, cb)
+}
+
+// WithViewSubscriptionBuffer configures how many pending updates are
+// buffered per Subscription. Once full, further updates for that
+// subscription are dropped (with a warning) rather than blocking the
+// partition's update path. Defaults to defaultSubscriptionBufSize.
+func WithViewSubscriptionBuffer(size int) ViewOption {
+	return func(o *voptions) {
+		o.subscriptionBufSize = size
+	}
+}
+
+// withSubscriptionNotify wraps base so that, once the View has reached
+// ViewStateRunning, every applied update also reads the previous value from
+// storage and fans both values out to matching subscriptions. Updates
+// applied while still catching up do not notify subscribers, to avoid
+// replaying the whole log through them on startup.
+func (v *View) withSubscriptionNotify(base UpdateCallback) UpdateCallback {
+	return func(s storage.Storage, partition int32, key string, value []byte) error {
+		if atomic.LoadInt32(&v.running) == 0 {
+			return base(s, partition, key, value)
+		}
+
+		var oldVal interface{}
+		if raw, err := s.Get(key); err == nil && raw != nil {
+			oldVal, _ = v.opts.tableCodec.Decode(raw)
+		}
+
+		if err := base(s, partition, key, value); err != nil {
+			return err
+		}
+
+		// a tombstone (nil/empty value, e.g. a Kafka delete) has nothing to
+		// decode; treat it as newVal == nil instead of feeding raw tombstone
+		// bytes into Decode, matching how DefaultUpdate/storage already
+		// treat deletes.
+		var newVal interface{}
+		if len(value) > 0 {
+			var err error
+			newVal, err = v.opts.tableCodec.Decode(value)
+			if err != nil {
+				return err
+			}
+		}
+
+		v.subs.notify(key, oldVal, newVal)
+		return nil
+	}
+}